@@ -0,0 +1,574 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package parse implements a lexer and parser for mathexp's expression
+// language: the small boolean/arithmetic language used by alert conditions
+// and reduce/math expressions (e.g. `${A} > 1 && abs($B) < 2`). The lexer is
+// modeled on text/template/parse.
+package parse
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Pos represents a byte position in the original input text from which
+// this expression was parsed.
+type Pos int
+
+// itemType identifies the type of lex items.
+type itemType int
+
+const (
+	itemError      itemType = iota // error occurred; value is text of error
+	itemEOF                        // end of input
+	itemNot                        // '!'
+	itemAnd                        // "&&"
+	itemOr                         // "||"
+	itemGreater                    // '>'
+	itemLess                       // '<'
+	itemGreaterEq                  // ">="
+	itemLessEq                     // "<="
+	itemEq                         // "=="
+	itemNotEq                      // "!="
+	itemPlus                       // '+'
+	itemMinus                      // '-'
+	itemMult                       // '*'
+	itemDiv                        // '/'
+	itemMod                        // '%'
+	itemNumber                     // number, e.g. "1.2e-4"
+	itemComma                      // ','
+	itemLeftParen                  // '('
+	itemRightParen                 // ')'
+	itemString                     // quoted string, e.g. "\"foo\""
+	itemFunc                       // function name, e.g. "abs"
+	itemVar                        // variable reference, e.g. "$A" or "${My Var}"
+	itemComment                    // '#' comment to end of line, only emitted if options.emitComments
+)
+
+// options carries lexer feature toggles. They're set when lex or lexReader
+// builds the lexer and aren't changed afterwards; the state machine reads
+// them as it scans, one item per nextItem call.
+type options struct {
+	allowVarFuncs bool // allow bare identifiers as function calls, e.g. abs(...)
+	allowUnaryOps bool // allow the unary '!' operator
+	emitComments  bool // emit itemComment tokens instead of discarding '#' comments
+	varSeps       string
+}
+
+func defaultOptions() options {
+	return options{
+		allowVarFuncs: true,
+		allowUnaryOps: true,
+		varSeps:       ".:",
+	}
+}
+
+// Option configures a Tree (and the lexer it drives) at construction time.
+type Option func(*options)
+
+// WithFuncs controls whether bare identifiers are accepted as function
+// calls (e.g. abs($A)). It's on by default.
+func WithFuncs(allow bool) Option {
+	return func(o *options) { o.allowVarFuncs = allow }
+}
+
+// WithUnaryOps controls whether the unary '!' operator is accepted. It's on
+// by default; some embedders that only ever need comparisons disable it.
+func WithUnaryOps(allow bool) Option {
+	return func(o *options) { o.allowUnaryOps = allow }
+}
+
+// WithComments controls whether '#' line comments are emitted as
+// itemComment tokens (true) or silently discarded (false, the default) by
+// the lexer. Parse and ParseReader have no grammar production for comments
+// either way, so with WithComments(true) they simply drop itemComment
+// tokens as they're read; the option only changes what direct callers of
+// the lexer see.
+func WithComments(emit bool) Option {
+	return func(o *options) { o.emitComments = emit }
+}
+
+// WithVarSyntax sets the characters allowed as namespace separators inside
+// ${...} variable references, e.g. WithVarSyntax(".", ":") to allow
+// ${ns:my.metric}.
+func WithVarSyntax(seps ...string) Option {
+	return func(o *options) { o.varSeps = strings.Join(seps, "") }
+}
+
+// item is a token returned from the lexer.
+type item struct {
+	typ  itemType
+	pos  Pos
+	line int // 1-based line of the token's first rune
+	col  int // 1-based column of the token's first rune
+
+	// val is the token's value: for itemVar, the cleaned variable name
+	// (e.g. "My Var" or "ns:my.metric", without the $ or {} wrapper);
+	// for every other token type, it's identical to raw.
+	val string
+	// raw is the original source text for this token, unmodified (for
+	// itemError, it's the error message, as in val). Error messages about a
+	// variable should quote this, not val, since val may have had its
+	// wrapper stripped.
+	raw string
+}
+
+func (i item) String() string {
+	switch i.typ {
+	case itemEOF:
+		return "EOF"
+	case itemError:
+		return i.val
+	}
+	if len(i.val) > 10 {
+		return fmt.Sprintf("%.10q...", i.val)
+	}
+	return fmt.Sprintf("%q", i.val)
+}
+
+const eof = -1
+
+// stateFn represents a state of the scanner as a function that, given the
+// lexer, produces at most one item into l.item before returning the state
+// that should run next.
+type stateFn func(*lexer) stateFn
+
+// lexer scans an expression and emits items one at a time via nextItem.
+// The state machine runs synchronously on the caller's goroutine: each
+// stateFn returns as soon as it has populated l.item (or reached EOF or an
+// error), so there is no background goroutine to cancel or leak, even when
+// Parse abandons a lexer partway through.
+type lexer struct {
+	buf     []byte    // window of input currently held in memory
+	bufBase Pos       // absolute position corresponding to buf[0]
+	trim    bool      // set by lexReader: drop consumed bytes from buf as we go
+	reader  io.Reader // source of further bytes; nil once fully buffered
+	opts    options
+	state   stateFn
+	pos     Pos // current position, absolute over the whole input
+	start   Pos // start position of this item, absolute
+	width   Pos // width of last rune read
+
+	line, col           int // line/col of l.pos
+	prevLine, prevCol   int // line/col of l.pos before the last next(), for backup()
+	startLine, startCol int // line/col of l.start, i.e. of the item being scanned
+
+	item    item
+	emitted bool // set by emit/errorf to signal nextItem to stop
+}
+
+func newLexer(opts options) *lexer {
+	return &lexer{
+		opts:      opts,
+		state:     lexText,
+		line:      1,
+		col:       1,
+		startLine: 1,
+		startCol:  1,
+	}
+}
+
+// lex creates a new lexer for the input string, configured with opts. The
+// whole string is available to it up front.
+func lex(input string, opts options) *lexer {
+	l := newLexer(opts)
+	l.buf = []byte(input)
+	return l
+}
+
+// lexReader creates a new lexer that reads its input incrementally from r,
+// so long inputs don't have to be materialized as a single string up front
+// or held in full once lexed: buf only ever holds the window between the
+// start of the token currently being scanned and however far ahead next()
+// has read, since trimBuf drops everything before that on every emit,
+// emitVar and ignore. Tokenization is otherwise identical to lex.
+func lexReader(r io.Reader, opts options) *lexer {
+	l := newLexer(opts)
+	l.reader = r
+	l.trim = true
+	return l
+}
+
+// fill ensures buf has at least enough bytes past l.pos to decode a full
+// rune, pulling more from the reader if one was supplied. It's a no-op once
+// the reader is exhausted or lex (rather than lexReader) built the lexer.
+func (l *lexer) fill() {
+	idx := l.pos - l.bufBase
+	for l.reader != nil && Pos(len(l.buf)) < idx+Pos(utf8.UTFMax) {
+		chunk := make([]byte, 512)
+		n, err := l.reader.Read(chunk)
+		if n > 0 {
+			l.buf = append(l.buf, chunk[:n]...)
+		}
+		if err != nil {
+			l.reader = nil
+		}
+	}
+}
+
+// slice returns the bytes of the original input between absolute positions
+// from and to, translated into indices of the (possibly trimmed) buf.
+func (l *lexer) slice(from, to Pos) []byte {
+	return l.buf[from-l.bufBase : to-l.bufBase]
+}
+
+// trimBuf drops bytes before l.start from buf when l.trim is set. Once
+// l.start has advanced past them they can never be read again: backup()
+// only rewinds by a single rune from pos, and pos never precedes start.
+// This is what keeps a lexReader's memory bounded by the distance between
+// tokens rather than by the whole input. It's skipped for a string-backed
+// lexer, where buf already holds the whole input up front and shifting it
+// on every token would turn an O(n) scan into O(n^2) for no benefit.
+func (l *lexer) trimBuf() {
+	if !l.trim {
+		return
+	}
+	drop := int(l.start - l.bufBase)
+	if drop <= 0 {
+		return
+	}
+	n := copy(l.buf, l.buf[drop:])
+	l.buf = l.buf[:n]
+	l.bufBase = l.start
+}
+
+// next returns the next rune in the input.
+func (l *lexer) next() rune {
+	l.fill()
+	idx := int(l.pos - l.bufBase)
+	if idx >= len(l.buf) {
+		l.width = 0
+		// Nothing was consumed, so backup() must be a no-op: make the
+		// saved position the same as the current one.
+		l.prevLine, l.prevCol = l.line, l.col
+		return eof
+	}
+	r, w := utf8.DecodeRune(l.buf[idx:])
+	l.width = Pos(w)
+	l.pos += l.width
+	l.prevLine, l.prevCol = l.line, l.col
+	if r == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	return r
+}
+
+// peek returns but does not consume the next rune in the input.
+func (l *lexer) peek() rune {
+	r := l.next()
+	l.backup()
+	return r
+}
+
+// backup steps back one rune. Can only be called once per call of next.
+func (l *lexer) backup() {
+	l.pos -= l.width
+	l.line, l.col = l.prevLine, l.prevCol
+}
+
+// emit passes an item back to the caller.
+func (l *lexer) emit(t itemType) {
+	raw := string(l.slice(l.start, l.pos))
+	l.item = item{t, l.start, l.startLine, l.startCol, raw, raw}
+	l.start = l.pos
+	l.startLine, l.startCol = l.line, l.col
+	l.trimBuf()
+	l.emitted = true
+}
+
+// emitVar emits an itemVar whose val is the cleaned variable name, with
+// raw preserving the full original source text (including the $ and, for
+// the curly form, the braces) for error reporting.
+func (l *lexer) emitVar(name string) {
+	l.item = item{itemVar, l.start, l.startLine, l.startCol, name, string(l.slice(l.start, l.pos))}
+	l.start = l.pos
+	l.startLine, l.startCol = l.line, l.col
+	l.trimBuf()
+	l.emitted = true
+}
+
+// ignore skips over the pending input before this point.
+func (l *lexer) ignore() {
+	l.start = l.pos
+	l.startLine, l.startCol = l.line, l.col
+	l.trimBuf()
+}
+
+// accept consumes the next rune if it's from the valid set.
+func (l *lexer) accept(valid string) bool {
+	if strings.ContainsRune(valid, l.next()) {
+		return true
+	}
+	l.backup()
+	return false
+}
+
+// acceptRun consumes a run of runes from the valid set.
+func (l *lexer) acceptRun(valid string) {
+	for l.accept(valid) {
+	}
+}
+
+// errorf emits an error item and terminates the scan.
+func (l *lexer) errorf(format string, args ...interface{}) stateFn {
+	msg := fmt.Sprintf(format, args...)
+	l.item = item{itemError, l.start, l.startLine, l.startCol, msg, msg}
+	l.start = l.pos
+	l.startLine, l.startCol = l.line, l.col
+	l.emitted = true
+	return nil
+}
+
+// nextItem drives the state machine forward until a single item has been
+// produced, then returns it. Because everything above runs synchronously,
+// calling nextItem repeatedly after EOF or an error is safe and
+// deterministic: it just keeps returning the final item.
+func (l *lexer) nextItem() item {
+	for l.state != nil {
+		l.state = l.state(l)
+		if l.emitted {
+			l.emitted = false
+			return l.item
+		}
+	}
+	return l.item
+}
+
+// state functions
+
+func lexText(l *lexer) stateFn {
+	r := l.next()
+	switch {
+	case r == eof:
+		l.emit(itemEOF)
+		return nil
+	case isSpace(r):
+		l.ignore()
+		return lexText
+	case r == '"':
+		return lexQuote
+	case r == '$':
+		return lexVariable
+	case r == '#':
+		return lexComment
+	case r == '!':
+		if l.peek() == '=' {
+			l.next()
+			l.emit(itemNotEq)
+			return lexText
+		}
+		if !l.opts.allowUnaryOps {
+			return l.errorf("unary ! is not enabled")
+		}
+		l.emit(itemNot)
+		return lexText
+	case r == '&':
+		if l.peek() != '&' {
+			return l.errorf("invalid character: %c", r)
+		}
+		l.next()
+		l.emit(itemAnd)
+		return lexText
+	case r == '|':
+		if l.peek() != '|' {
+			return l.errorf("invalid character: %c", r)
+		}
+		l.next()
+		l.emit(itemOr)
+		return lexText
+	case r == '<':
+		if l.peek() == '=' {
+			l.next()
+			l.emit(itemLessEq)
+		} else {
+			l.emit(itemLess)
+		}
+		return lexText
+	case r == '>':
+		if l.peek() == '=' {
+			l.next()
+			l.emit(itemGreaterEq)
+		} else {
+			l.emit(itemGreater)
+		}
+		return lexText
+	case r == '=':
+		if l.peek() != '=' {
+			return l.errorf("invalid character: %c", r)
+		}
+		l.next()
+		l.emit(itemEq)
+		return lexText
+	case r == '+':
+		l.emit(itemPlus)
+		return lexText
+	case r == '-':
+		l.emit(itemMinus)
+		return lexText
+	case r == '*':
+		l.emit(itemMult)
+		return lexText
+	case r == '/':
+		l.emit(itemDiv)
+		return lexText
+	case r == '%':
+		l.emit(itemMod)
+		return lexText
+	case r == ',':
+		l.emit(itemComma)
+		return lexText
+	case r == '(':
+		l.emit(itemLeftParen)
+		return lexText
+	case r == ')':
+		l.emit(itemRightParen)
+		return lexText
+	case r == '.' || ('0' <= r && r <= '9'):
+		l.backup()
+		return lexNumber
+	case isAlphaNumeric(r):
+		l.backup()
+		return lexIdentifier
+	default:
+		return l.errorf("invalid character: %c", r)
+	}
+}
+
+// lexComment scans a '#' comment to the end of the line (or input). It's
+// discarded unless opts.emitComments is set.
+func lexComment(l *lexer) stateFn {
+	for {
+		r := l.peek()
+		if r == eof || r == '\n' {
+			break
+		}
+		l.next()
+	}
+	if l.opts.emitComments {
+		l.emit(itemComment)
+	} else {
+		l.ignore()
+	}
+	return lexText
+}
+
+func lexQuote(l *lexer) stateFn {
+	for {
+		switch l.next() {
+		case '\\':
+			if r := l.next(); r != eof {
+				continue
+			}
+			fallthrough
+		case eof:
+			return l.errorf("unterminated string")
+		case '"':
+			l.emit(itemString)
+			return lexText
+		}
+	}
+}
+
+// lexVariable scans a variable reference, either the bare form ($A) or the
+// curly-brace form (${My Var} or ${ns:my.metric}). Either way it emits an
+// itemVar whose val is the cleaned name, not the raw source text.
+func lexVariable(l *lexer) stateFn {
+	if l.peek() == '{' {
+		l.next()
+		nameStart := l.pos
+		for {
+			switch l.next() {
+			case eof:
+				return l.errorf("unterminated variable missing closing }")
+			case '}':
+				name := string(l.slice(nameStart, l.pos-1))
+				if err := validateVarName(name, l.opts.varSeps); err != nil {
+					return l.errorf("invalid variable %q: %s", l.slice(l.start, l.pos), err)
+				}
+				l.emitVar(name)
+				return lexText
+			}
+		}
+	}
+	if !isAlphaNumeric(l.peek()) {
+		return l.errorf("incomplete variable")
+	}
+	nameStart := l.pos
+	for isAlphaNumeric(l.peek()) {
+		l.next()
+	}
+	l.emitVar(string(l.slice(nameStart, l.pos)))
+	return lexText
+}
+
+// validateVarName reports an error if name isn't a valid variable name:
+// letters, digits, underscores, spaces, and the configured namespace
+// separators (seps), with at least one character.
+func validateVarName(name, seps string) error {
+	if name == "" {
+		return fmt.Errorf("empty variable name")
+	}
+	for _, r := range name {
+		switch {
+		case r == ' ', r == '_', unicode.IsLetter(r), unicode.IsDigit(r):
+		case strings.ContainsRune(seps, r):
+		default:
+			return fmt.Errorf("invalid character %q in variable name", r)
+		}
+	}
+	return nil
+}
+
+func lexNumber(l *lexer) stateFn {
+	if !l.scanNumber() {
+		return l.errorf("bad number syntax: %q", l.slice(l.start, l.pos))
+	}
+	l.emit(itemNumber)
+	return lexText
+}
+
+func (l *lexer) scanNumber() bool {
+	digits := "0123456789"
+	if l.accept("0") {
+		if l.accept("xX") {
+			digits = "0123456789abcdefABCDEF"
+		}
+	}
+	l.acceptRun(digits)
+	if l.accept(".") {
+		l.acceptRun(digits)
+	}
+	if l.accept("eE") {
+		l.accept("+-")
+		l.acceptRun("0123456789")
+	}
+	return !isAlphaNumeric(l.peek())
+}
+
+// lexIdentifier scans a bare identifier, used as a function name.
+func lexIdentifier(l *lexer) stateFn {
+	for isAlphaNumeric(l.peek()) {
+		l.next()
+	}
+	if !l.opts.allowVarFuncs {
+		return l.errorf("function calls are not enabled: %q", l.slice(l.start, l.pos))
+	}
+	l.emit(itemFunc)
+	return lexText
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+func isAlphaNumeric(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -6,9 +6,7 @@ package parse
 
 import (
 	"fmt"
-	"runtime"
 	"testing"
-	"time"
 )
 
 // Make the types prettyprint.
@@ -35,6 +33,7 @@ var itemName = map[itemType]string{
 	itemRightParen: ")",
 	itemString:     "string",
 	itemFunc:       "func",
+	itemComment:    "comment",
 }
 
 func (i itemType) String() string {
@@ -52,27 +51,29 @@ type lexTest struct {
 }
 
 var (
-	tEOF   = item{itemEOF, 0, ""}
-	tLt    = item{itemLess, 0, "<"}
-	tGt    = item{itemGreater, 0, ">"}
-	tOr    = item{itemOr, 0, "||"}
-	tNot   = item{itemNot, 0, "!"}
-	tAnd   = item{itemAnd, 0, "&&"}
-	tLtEq  = item{itemLessEq, 0, "<="}
-	tGtEq  = item{itemGreaterEq, 0, ">="}
-	tNotEq = item{itemNotEq, 0, "!="}
-	tEq    = item{itemEq, 0, "=="}
-	tPlus  = item{itemPlus, 0, "+"}
-	tMinus = item{itemMinus, 0, "-"}
-	tMult  = item{itemMult, 0, "*"}
-	tDiv   = item{itemDiv, 0, "/"}
-	tMod   = item{itemMod, 0, "%"}
+	tEOF   = item{typ: itemEOF}
+	tLt    = item{typ: itemLess, val: "<"}
+	tGt    = item{typ: itemGreater, val: ">"}
+	tOr    = item{typ: itemOr, val: "||"}
+	tNot   = item{typ: itemNot, val: "!"}
+	tAnd   = item{typ: itemAnd, val: "&&"}
+	tLtEq  = item{typ: itemLessEq, val: "<="}
+	tGtEq  = item{typ: itemGreaterEq, val: ">="}
+	tNotEq = item{typ: itemNotEq, val: "!="}
+	tEq    = item{typ: itemEq, val: "=="}
+	tPlus  = item{typ: itemPlus, val: "+"}
+	tMinus = item{typ: itemMinus, val: "-"}
+	tMult  = item{typ: itemMult, val: "*"}
+	tDiv   = item{typ: itemDiv, val: "/"}
+	tMod   = item{typ: itemMod, val: "%"}
 )
 
+func tVar(val string) item { return item{typ: itemVar, val: val} }
+
 var lexTests = []lexTest{
 	{"empty", "", []item{tEOF}},
 	{"spaces", " \t\n", []item{tEOF}},
-	{"text", `"now is the time"`, []item{{itemString, 0, `"now is the time"`}, tEOF}},
+	{"text", `"now is the time"`, []item{{typ: itemString, val: `"now is the time"`}, tEOF}},
 	{"operators", "! && || < > <= >= == != + - * / %", []item{
 		tNot,
 		tAnd,
@@ -91,48 +92,54 @@ var lexTests = []lexTest{
 		tEOF,
 	}},
 	{"numbers", "1 02 0x14 7.2 1e3 1.2e-4", []item{
-		{itemNumber, 0, "1"},
-		{itemNumber, 0, "02"},
-		{itemNumber, 0, "0x14"},
-		{itemNumber, 0, "7.2"},
-		{itemNumber, 0, "1e3"},
-		{itemNumber, 0, "1.2e-4"},
+		{typ: itemNumber, val: "1"},
+		{typ: itemNumber, val: "02"},
+		{typ: itemNumber, val: "0x14"},
+		{typ: itemNumber, val: "7.2"},
+		{typ: itemNumber, val: "1e3"},
+		{typ: itemNumber, val: "1.2e-4"},
 		tEOF,
 	}},
 	{"curly brace var", "${My Var}", []item{
-		{itemVar, 0, "${My Var}"},
+		tVar("My Var"),
 		tEOF,
 	}},
 	{"curly brace var plus 1", "${My Var} + 1", []item{
-		{itemVar, 0, "${My Var}"},
+		tVar("My Var"),
 		tPlus,
-		{itemNumber, 0, "1"},
+		{typ: itemNumber, val: "1"},
 		tEOF,
 	}},
 	{"number plus var", "1 + $A", []item{
-		{itemNumber, 0, "1"},
+		{typ: itemNumber, val: "1"},
 		tPlus,
-		{itemVar, 0, "$A"},
+		tVar("A"),
 		tEOF,
 	}},
 	// errors
 	{"unclosed quote", "\"", []item{
-		{itemError, 0, "unterminated string"},
+		{typ: itemError, val: "unterminated string"},
 	}},
 	{"single quote", "'single quote is invalid'", []item{
-		{itemError, 0, "invalid character: '"},
+		{typ: itemError, val: "invalid character: '"},
 	}},
 	{"invalid var", "$", []item{
-		{itemError, 0, "incomplete variable"},
+		{typ: itemError, val: "incomplete variable"},
 	}},
 	{"invalid curly var", "${adf sd", []item{
-		{itemError, 0, "unterminated variable missing closing }"},
+		{typ: itemError, val: "unterminated variable missing closing }"},
 	}},
 }
 
 // collect gathers the emitted items into a slice.
 func collect(t *lexTest) (items []item) {
-	l := lex(t.input)
+	return collectWithOptions(t, defaultOptions())
+}
+
+// collectWithOptions is like collect but lexes with the given options, so
+// tests can exercise how feature toggles change the token stream.
+func collectWithOptions(t *lexTest, opts options) (items []item) {
+	l := lex(t.input, opts)
 	for {
 		item := l.nextItem()
 		items = append(items, item)
@@ -154,7 +161,7 @@ func equal(i1, i2 []item, checkPos bool) bool {
 		if i1[k].val != i2[k].val {
 			return false
 		}
-		if checkPos && i1[k].pos != i2[k].pos {
+		if checkPos && (i1[k].pos != i2[k].pos || i1[k].line != i2[k].line || i1[k].col != i2[k].col) {
 			return false
 		}
 	}
@@ -170,69 +177,149 @@ func TestLex(t *testing.T) {
 	}
 }
 
-// TestLexerClose verifies that a lexer can be explicitly closed
-func TestLexerClose(t *testing.T) {
-	// Create a lexer with some input
-	lexer := lex("1 + 2")
-
-	// Read one item to verify it's working
-	item := lexer.nextItem()
-	if item.typ != itemNumber || item.val != "1" {
-		t.Errorf("unexpected first item: %v", item)
-	}
-
-	// Close the lexer explicitly
-	lexer.Close()
-
-	// Verify the lexer's channel closes
-	select {
-	case _, ok := <-lexer.items:
-		if ok {
-			t.Fatal("lexer.items channel should be closed after lexer.Close()")
+// TestNextItemEOF verifies that nextItem deterministically settles on EOF
+// once the input is exhausted. There's no goroutine or channel behind this
+// anymore, so there's nothing to close and nothing that can leak.
+func TestNextItemEOF(t *testing.T) {
+	l := lex("1 + 2", defaultOptions())
+	for {
+		item := l.nextItem()
+		if item.typ == itemError {
+			t.Fatalf("unexpected error item: %v", item)
 		}
-	case <-time.After(100 * time.Millisecond):
-		t.Fatal("timed out waiting for lexer.items channel to close")
+		if item.typ == itemEOF {
+			break
+		}
+	}
+	// Calling nextItem again after EOF must keep returning EOF rather than
+	// blocking on a channel that nothing is feeding anymore.
+	if item := l.nextItem(); item.typ != itemEOF {
+		t.Errorf("nextItem after EOF = %v, want itemEOF", item)
 	}
 }
 
-// TestParseErrorNoLeak verifies that lexer goroutines are properly terminated when Parse encounters errors
-func TestParseErrorNoLeak(t *testing.T) {
-	// Count initial goroutines
-	initialGoroutines := runtime.NumGoroutine()
-
-	// Create several trees with parsing errors to check for leaks
+// TestParseErrorClearsLexer verifies that a parse error resolves
+// synchronously: Parse returns an error and clears tree.lex with no
+// background state left running that would need to be torn down.
+func TestParseErrorClearsLexer(t *testing.T) {
 	for i := 0; i < 10; i++ {
 		tree := New()
-		input := "invalid expression with $"
-		err := tree.Parse(input)
-
-		// Verify that Parse returned an error
-		if err == nil {
+		if err := tree.Parse("invalid expression with $"); err == nil {
 			t.Fatal("expected error but got nil")
 		}
-
-		// Verify that tree.lex is nil after an error
 		if tree.lex != nil {
 			t.Fatal("tree.lex was not set to nil after error")
 		}
 	}
+}
 
-	// Poll for goroutine count to stabilize
-	deadline := time.Now().Add(500 * time.Millisecond)
-	var finalGoroutines int
+// TestLexOptionsComments verifies that a lexer's comment handling is fixed
+// by the options it's constructed with: the same input produces a
+// different token stream depending on whether comments are requested.
+func TestLexOptionsComments(t *testing.T) {
+	test := &lexTest{name: "comment", input: "$A # note"}
 
-	for time.Now().Before(deadline) {
-		finalGoroutines = runtime.NumGoroutine()
-		// If we're close to the initial count, we can exit early
-		if finalGoroutines <= initialGoroutines+2 {
-			break
+	discarded := collectWithOptions(test, defaultOptions())
+	want := []item{tVar("A"), tEOF}
+	if !equal(discarded, want, false) {
+		t.Errorf("emitComments=false: got\n\t%+v\nexpected\n\t%v", discarded, want)
+	}
+
+	emitted := collectWithOptions(test, options{allowVarFuncs: true, allowUnaryOps: true, emitComments: true})
+	want = []item{tVar("A"), {typ: itemComment, val: "# note"}, tEOF}
+	if !equal(emitted, want, false) {
+		t.Errorf("emitComments=true: got\n\t%+v\nexpected\n\t%v", emitted, want)
+	}
+}
+
+// TestLexOptionsFuncs verifies that disabling function calls turns what
+// would otherwise be an itemFunc token into an itemError.
+func TestLexOptionsFuncs(t *testing.T) {
+	test := &lexTest{name: "func", input: "abs(1)"}
+
+	allowed := collectWithOptions(test, defaultOptions())
+	want := []item{{typ: itemFunc, val: "abs"}, {typ: itemLeftParen, val: "("}, {typ: itemNumber, val: "1"}, {typ: itemRightParen, val: ")"}, tEOF}
+	if !equal(allowed, want, false) {
+		t.Errorf("allowVarFuncs=true: got\n\t%+v\nexpected\n\t%v", allowed, want)
+	}
+
+	disallowed := collectWithOptions(test, options{allowUnaryOps: true})
+	if len(disallowed) == 0 || disallowed[0].typ != itemError {
+		t.Errorf("allowVarFuncs=false: got\n\t%+v\nexpected an itemError", disallowed)
+	}
+}
+
+// TestLexOptionsUnaryOps verifies that disabling unary operators turns a
+// bare '!' into an itemError while leaving '!=' untouched.
+func TestLexOptionsUnaryOps(t *testing.T) {
+	test := &lexTest{name: "unary", input: "! a != b"}
+
+	disallowed := collectWithOptions(test, options{allowVarFuncs: true})
+	if len(disallowed) == 0 || disallowed[0].typ != itemError {
+		t.Errorf("allowUnaryOps=false: got\n\t%+v\nexpected an itemError", disallowed)
+	}
+
+	notEq := collectWithOptions(&lexTest{name: "noteq", input: "a != b"}, options{allowVarFuncs: true})
+	want := []item{{typ: itemFunc, val: "a"}, tNotEq, {typ: itemFunc, val: "b"}, tEOF}
+	if !equal(notEq, want, false) {
+		t.Errorf("allowUnaryOps=false: got\n\t%+v\nexpected\n\t%v", notEq, want)
+	}
+}
+
+// TestLexPos verifies that line and column are tracked correctly across
+// newlines.
+func TestLexPos(t *testing.T) {
+	l := lex("${A}\n+\n$B", defaultOptions())
+
+	want := []item{
+		{typ: itemVar, line: 1, col: 1, val: "A"},
+		{typ: itemPlus, line: 2, col: 1, val: "+"},
+		{typ: itemVar, line: 3, col: 1, val: "B"},
+	}
+	for i, w := range want {
+		got := l.nextItem()
+		if got.typ != w.typ || got.val != w.val || got.line != w.line || got.col != w.col {
+			t.Errorf("item %d: got {typ:%v line:%d col:%d val:%q}, want {typ:%v line:%d col:%d val:%q}",
+				i, got.typ, got.line, got.col, got.val, w.typ, w.line, w.col, w.val)
 		}
-		time.Sleep(10 * time.Millisecond)
 	}
+}
 
-	// Check if we've leaked goroutines (with a small buffer for normal variations)
-	if finalGoroutines > initialGoroutines+5 {
-		t.Fatalf("Goroutine leak detected: started with %d goroutines, ended with %d (difference of %d)",
-			initialGoroutines, finalGoroutines, finalGoroutines-initialGoroutines)
+// TestLexVarName verifies that ${...} variable references are validated
+// and that itemVar.val carries the cleaned name while raw keeps the
+// original source text.
+func TestLexVarName(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantVal string // empty if wantErr
+		wantErr bool
+	}{
+		{name: "namespaced", input: "${ns:my.metric}", wantVal: "ns:my.metric"},
+		{name: "spaces", input: "${My Var}", wantVal: "My Var"},
+		{name: "bare", input: "$A", wantVal: "A"},
+		{name: "empty name", input: "${}", wantErr: true},
+		{name: "control character", input: "${My\x01Var}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lex(tt.input, defaultOptions())
+			got := l.nextItem()
+			if tt.wantErr {
+				if got.typ != itemError {
+					t.Fatalf("got %v, want itemError", got)
+				}
+				return
+			}
+			if got.typ != itemVar {
+				t.Fatalf("got %v, want itemVar", got)
+			}
+			if got.val != tt.wantVal {
+				t.Errorf("val = %q, want %q", got.val, tt.wantVal)
+			}
+			if got.raw != tt.input {
+				t.Errorf("raw = %q, want %q", got.raw, tt.input)
+			}
+		})
 	}
 }
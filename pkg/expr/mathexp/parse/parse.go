@@ -0,0 +1,264 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parse
+
+import (
+	"fmt"
+	"io"
+)
+
+// Node is an element in the parse tree.
+type Node interface {
+	Position() Pos
+}
+
+// Position returns p itself, satisfying Node for embedders.
+func (p Pos) Position() Pos { return p }
+
+// NumberNode holds a numeric literal.
+type NumberNode struct {
+	Pos
+	Text string
+}
+
+// StringNode holds a quoted string literal (Text includes the quotes).
+type StringNode struct {
+	Pos
+	Text string
+}
+
+// VarNode holds a reference to a query variable, e.g. $A or ${My Var}.
+// Name is the cleaned variable name (e.g. "My Var" or "ns:my.metric").
+// Raw preserves the original source text, including the $ and, if
+// present, the braces, for error messages that need to quote exactly
+// what the user wrote.
+type VarNode struct {
+	Pos
+	Name string
+	Raw  string
+}
+
+// FuncNode holds a function call, e.g. abs($A, 1).
+type FuncNode struct {
+	Pos
+	Name string
+	Args []Node
+}
+
+// BinaryNode holds a binary operator expression, e.g. $A + 1.
+type BinaryNode struct {
+	Pos
+	Op       itemType
+	Lhs, Rhs Node
+}
+
+// UnaryNode holds a unary operator expression, e.g. !$A.
+type UnaryNode struct {
+	Pos
+	Op   itemType
+	Node Node
+}
+
+// Tree is the representation of a single parsed expression.
+type Tree struct {
+	Root Node
+
+	opts      options
+	lex       *lexer
+	token     [1]item // one-token lookahead for backup
+	peekCount int
+}
+
+// New allocates a new parse tree. Feature toggles such as WithFuncs or
+// WithComments must be passed here: they configure the lexer Parse
+// constructs, and a lexer can't be safely reconfigured once it starts
+// scanning.
+func New(opts ...Option) *Tree {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Tree{opts: o}
+}
+
+// Error reports a parse failure together with the line and column of the
+// token that triggered it, so callers can point a user at the offending
+// part of their expression rather than just echoing the lexer's message.
+type Error struct {
+	Line, Col int
+	Msg       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d, col %d: %s", e.Line, e.Col, e.Msg)
+}
+
+// Parse parses the expression in input, storing the result in t.Root.
+func (t *Tree) Parse(input string) (err error) {
+	return t.parse(lex(input, t.opts))
+}
+
+// ParseReader is like Parse, but reads the expression incrementally from r
+// instead of requiring the caller to already have it materialized as a
+// string: the lexer only holds the bytes between the start of the token
+// it's currently scanning and however far ahead it has read from r, not the
+// whole input, so long machine-generated expressions don't have to be
+// fully buffered.
+func (t *Tree) ParseReader(r io.Reader) (err error) {
+	return t.parse(lexReader(r, t.opts))
+}
+
+func (t *Tree) parse(l *lexer) (err error) {
+	t.lex = l
+	defer func() { t.lex = nil }()
+	defer t.recover(&err)
+	t.Root = t.parseExpr(0)
+	t.expect(itemEOF)
+	return nil
+}
+
+func (t *Tree) recover(errp *error) {
+	if e := recover(); e != nil {
+		if pe, ok := e.(*Error); ok {
+			*errp = pe
+			return
+		}
+		panic(e)
+	}
+}
+
+// errorAt reports a parse error positioned at tok.
+func (t *Tree) errorAt(tok item, format string, args ...interface{}) {
+	panic(&Error{Line: tok.line, Col: tok.col, Msg: fmt.Sprintf(format, args...)})
+}
+
+// next returns the next token.
+func (t *Tree) next() item {
+	if t.peekCount > 0 {
+		t.peekCount--
+	} else {
+		t.token[0] = t.lexNext()
+	}
+	return t.token[t.peekCount]
+}
+
+// backup pushes the last-read token back onto the stream.
+func (t *Tree) backup() {
+	t.peekCount++
+}
+
+// peek returns but does not consume the next token.
+func (t *Tree) peek() item {
+	if t.peekCount > 0 {
+		return t.token[t.peekCount-1]
+	}
+	t.peekCount = 1
+	t.token[0] = t.lexNext()
+	return t.token[0]
+}
+
+// lexNext pulls the next token from the lexer, silently discarding comments:
+// the parser has no grammar production for them, and WithComments exists for
+// callers that drive the lexer directly rather than through Parse.
+func (t *Tree) lexNext() item {
+	for {
+		tok := t.lex.nextItem()
+		if tok.typ != itemComment {
+			return tok
+		}
+	}
+}
+
+// expect consumes the next token, erroring if it is not of type typ.
+func (t *Tree) expect(typ itemType) item {
+	tok := t.next()
+	if tok.typ == itemError {
+		t.errorAt(tok, "%s", tok.val)
+	}
+	if tok.typ != typ {
+		t.errorAt(tok, "unexpected token %q", tok.val)
+	}
+	return tok
+}
+
+// binPrec gives the binding precedence of each binary operator; higher
+// binds tighter.
+var binPrec = map[itemType]int{
+	itemOr:        1,
+	itemAnd:       2,
+	itemEq:        3,
+	itemNotEq:     3,
+	itemLess:      4,
+	itemGreater:   4,
+	itemLessEq:    4,
+	itemGreaterEq: 4,
+	itemPlus:      5,
+	itemMinus:     5,
+	itemMult:      6,
+	itemDiv:       6,
+	itemMod:       6,
+}
+
+// parseExpr parses a (possibly binary) expression using precedence
+// climbing, stopping at the first operator binding looser than minPrec.
+func (t *Tree) parseExpr(minPrec int) Node {
+	lhs := t.parseUnary()
+	for {
+		op := t.peek()
+		prec, ok := binPrec[op.typ]
+		if !ok || prec < minPrec {
+			return lhs
+		}
+		t.next()
+		rhs := t.parseExpr(prec + 1)
+		lhs = &BinaryNode{Pos: lhs.Position(), Op: op.typ, Lhs: lhs, Rhs: rhs}
+	}
+}
+
+func (t *Tree) parseUnary() Node {
+	switch tok := t.peek(); tok.typ {
+	case itemNot, itemMinus:
+		t.next()
+		return &UnaryNode{Pos: tok.pos, Op: tok.typ, Node: t.parseUnary()}
+	}
+	return t.parsePrimary()
+}
+
+func (t *Tree) parsePrimary() Node {
+	tok := t.next()
+	switch tok.typ {
+	case itemNumber:
+		return &NumberNode{Pos: tok.pos, Text: tok.val}
+	case itemString:
+		return &StringNode{Pos: tok.pos, Text: tok.val}
+	case itemVar:
+		return &VarNode{Pos: tok.pos, Name: tok.val, Raw: tok.raw}
+	case itemFunc:
+		return t.parseFuncCall(tok)
+	case itemLeftParen:
+		n := t.parseExpr(0)
+		t.expect(itemRightParen)
+		return n
+	case itemError:
+		t.errorAt(tok, "%s", tok.val)
+	default:
+		t.errorAt(tok, "unexpected token %q", tok.val)
+	}
+	return nil
+}
+
+func (t *Tree) parseFuncCall(name item) Node {
+	t.expect(itemLeftParen)
+	var args []Node
+	if t.peek().typ != itemRightParen {
+		args = append(args, t.parseExpr(0))
+		for t.peek().typ == itemComma {
+			t.next()
+			args = append(args, t.parseExpr(0))
+		}
+	}
+	t.expect(itemRightParen)
+	return &FuncNode{Pos: name.pos, Name: name.val, Args: args}
+}
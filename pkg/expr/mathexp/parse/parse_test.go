@@ -0,0 +1,61 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parse
+
+import "testing"
+
+// TestParseErrorPosition verifies that a parse error reports the line and
+// column of the offending token, not just the lexer's raw message.
+func TestParseErrorPosition(t *testing.T) {
+	err := New().Parse("invalid expression with $")
+	if err == nil {
+		t.Fatal("expected error but got nil")
+	}
+	pe, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("error is %T, want *parse.Error", err)
+	}
+	if pe.Line != 1 || pe.Col != 9 {
+		t.Errorf("got line %d, col %d; want line 1, col 9 (the start of %q)", pe.Line, pe.Col, "expression")
+	}
+	const want = "line 1, col 9:"
+	if got := pe.Error(); got[:len(want)] != want {
+		t.Errorf("Error() = %q, want prefix %q", got, want)
+	}
+}
+
+// TestParseErrorPositionMultiline verifies that line/col tracking carries
+// across newlines into the reported error position.
+func TestParseErrorPositionMultiline(t *testing.T) {
+	err := New().Parse("${A}\n+\n$")
+	if err == nil {
+		t.Fatal("expected error but got nil")
+	}
+	pe, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("error is %T, want *parse.Error", err)
+	}
+	if pe.Line != 3 || pe.Col != 1 {
+		t.Errorf("got line %d, col %d; want line 3, col 1 (the incomplete $ on the last line)", pe.Line, pe.Col)
+	}
+}
+
+// TestParseWithComments verifies that Parse succeeds on input containing a
+// '#' comment even when WithComments(true) asks the lexer to emit comment
+// tokens: the parser has no grammar production for them, so it must discard
+// itemComment tokens as it reads rather than choking on them.
+func TestParseWithComments(t *testing.T) {
+	tr := New(WithComments(true))
+	if err := tr.Parse("$A # note"); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	v, ok := tr.Root.(*VarNode)
+	if !ok {
+		t.Fatalf("Root is %T, want *VarNode", tr.Root)
+	}
+	if v.Name != "A" {
+		t.Errorf("Root.Name = %q, want %q", v.Name, "A")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestLexReader streams every lexTests input through a strings.Reader and
+// checks that lexReader produces exactly the same token sequence as the
+// string-based lex, including positions.
+func TestLexReader(t *testing.T) {
+	for i, test := range lexTests {
+		l := lexReader(strings.NewReader(test.input), defaultOptions())
+		var got []item
+		for {
+			it := l.nextItem()
+			got = append(got, it)
+			if it.typ == itemEOF || it.typ == itemError {
+				break
+			}
+		}
+		want := collect(&lexTests[i])
+		if !equal(got, want, true) {
+			t.Errorf("%s: streamed\n\t%+v\nwant\n\t%v", test.name, got, want)
+		}
+	}
+}
+
+// TestParseReader verifies that ParseReader produces the same result as
+// Parse for a well-formed expression.
+func TestParseReader(t *testing.T) {
+	const input = "abs($A) + ${My Var} > 1"
+
+	strTree := New()
+	if err := strTree.Parse(input); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	readerTree := New()
+	if err := readerTree.ParseReader(strings.NewReader(input)); err != nil {
+		t.Fatalf("ParseReader: %v", err)
+	}
+
+	if !reflect.DeepEqual(strTree.Root, readerTree.Root) {
+		t.Errorf("ParseReader tree differs from Parse tree:\n\tgot  %#v\n\twant %#v", readerTree.Root, strTree.Root)
+	}
+}